@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -23,6 +24,7 @@ import (
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
 )
 
@@ -33,7 +35,8 @@ const (
 type CtxKey string
 
 const (
-	CtxKeyWithRetryUntil CtxKey = "complement_retry_until" // contains *retryUntilParams
+	CtxKeyWithRetryUntil    CtxKey = "complement_retry_until"     // contains *retryUntilParams
+	CtxKeyRoundTripDuration CtxKey = "complement_round_trip_time" // contains *time.Duration
 )
 
 type retryUntilParams struct {
@@ -79,7 +82,7 @@ type SyncReq struct {
 	// The maximum time to wait, in milliseconds, before returning this request. If no events
 	// (or other data) become available before this time elapses, the server will return a response
 	// with empty fields.
-	// By default, this is 1000 for Complement testing.
+	// By default, this is CSAPI.DefaultSyncTimeoutMillis, which is 1000 for Complement testing.
 	TimeoutMillis string // string for easier conversion to query params
 }
 
@@ -91,8 +94,19 @@ type CSAPI struct {
 	Client      *http.Client
 	// how long are we willing to wait for MustSyncUntil.... calls
 	SyncUntilTimeout time.Duration
+	// The /sync timeout to use when SyncReq.TimeoutMillis is empty. SyncReq.TimeoutMillis takes precedence.
+	// If this is empty, 1000 is used.
+	DefaultSyncTimeoutMillis string // string for easier conversion to query params
 	// True to enable verbose logging
 	Debug bool
+	// True to send the access token as the deprecated `access_token` query parameter instead of
+	// the Authorization header.
+	UseQueryToken bool
+	// RequestOpts which are applied to every request made by this client, e.g to add a tracing header
+	// or to simulate a proxy. These run before the per-call RequestOpts, so per-call RequestOpts can
+	// override them. Defaults which only apply if not already set, such as the Content-Type, are
+	// applied after both. The Authorization header is set before any RequestOpts run.
+	RequestMiddleware []RequestOpt
 
 	txnID int64
 }
@@ -109,20 +123,76 @@ func (c *CSAPI) UploadContent(t *testing.T, fileBody []byte, fileName string, co
 		WithRawBody(fileBody), WithContentType(contentType), WithQueries(query),
 	)
 	body := ParseJSON(t, res)
-	return GetJSONFieldStr(t, body, "content_uri")
+	mxcURI := GetJSONFieldStr(t, body, "content_uri")
+	if err := validateMxc(mxcURI); err != nil {
+		t.Fatalf("UploadContent: server returned a malformed content_uri: %s", err)
+	}
+	return mxcURI
+}
+
+// UploadContentExpectingError uploads the provided content with an optional file name and asserts that
+// the upload fails with `wantStatus` and, if it is not empty, the error code `wantErrcode`. This is
+// useful for testing over-limit and unsupported uploads. Fails the test if the response does not match.
+func (c *CSAPI) UploadContentExpectingError(t *testing.T, fileBody []byte, fileName, contentType string, wantStatus int, wantErrcode string) {
+	t.Helper()
+	query := url.Values{}
+	if fileName != "" {
+		query.Set("filename", fileName)
+	}
+	res := c.DoFunc(
+		t, "POST", []string{"_matrix", "media", "v3", "upload"},
+		WithRawBody(fileBody), WithContentType(contentType), WithQueries(query),
+	)
+	defer res.Body.Close()
+	wantRes := match.HTTPResponse{
+		StatusCode: wantStatus,
+	}
+	if wantErrcode != "" {
+		wantRes.JSON = []match.JSON{
+			match.JSONKeyEqual("errcode", wantErrcode),
+		}
+	}
+	must.MatchResponse(t, res, wantRes)
 }
 
 // DownloadContent downloads media from the server, returning the raw bytes and the Content-Type. Fails the test on error.
 func (c *CSAPI) DownloadContent(t *testing.T, mxcUri string) ([]byte, string) {
 	t.Helper()
-	origin, mediaId := SplitMxc(mxcUri)
-	res := c.MustDoFunc(t, "GET", []string{"_matrix", "media", "v3", "download", origin, mediaId})
-	contentType := res.Header.Get("Content-Type")
+	b, header := c.DownloadContentWithHeaders(t, mxcUri)
+	return b, header.Get("Content-Type")
+}
+
+// DownloadContentWithHeaders downloads media from the server, returning the raw bytes and all the response
+// headers, so that tests can assert on headers such as Content-Disposition. Fails the test on error.
+func (c *CSAPI) DownloadContentWithHeaders(t *testing.T, mxcURI string) ([]byte, http.Header) {
+	t.Helper()
+	origin, mediaID := SplitMxc(mxcURI)
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "media", "v3", "download", origin, mediaID})
+	defer res.Body.Close()
 	b, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		t.Error(err)
 	}
-	return b, contentType
+	return b, res.Header
+}
+
+// CreateMedia creates an MXC URI for asynchronous media uploads. Fails the test on error. Returns the MXC URI.
+func (c *CSAPI) CreateMedia(t *testing.T) string {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "media", "v1", "create"})
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "content_uri")
+}
+
+// UploadMediaAsync uploads the provided content to the given MXC URI, which must have been created
+// with CreateMedia. Fails the test on error.
+func (c *CSAPI) UploadMediaAsync(t *testing.T, mxcURI string, fileBody []byte, contentType string) {
+	t.Helper()
+	origin, mediaID := SplitMxc(mxcURI)
+	c.MustDoFunc(
+		t, "PUT", []string{"_matrix", "media", "v3", "upload", origin, mediaID},
+		WithRawBody(fileBody), WithContentType(contentType),
+	)
 }
 
 // CreateRoom creates a room with an optional HTTP request body. Fails the test on error. Returns the room ID.
@@ -133,18 +203,38 @@ func (c *CSAPI) CreateRoom(t *testing.T, creationContent interface{}) string {
 	return GetJSONFieldStr(t, body, "room_id")
 }
 
+// CreateRoomSynced is the same as CreateRoom but waits until the creator's join to the room comes down /sync.
+// Returns the room ID.
+func (c *CSAPI) CreateRoomSynced(t *testing.T, creationContent interface{}) string {
+	t.Helper()
+	roomID := c.CreateRoom(t, creationContent)
+	c.MustSyncUntil(t, SyncReq{}, SyncJoinedTo(c.UserID, roomID))
+	return roomID
+}
+
 // JoinRoom joins the room ID or alias given, else fails the test. Returns the room ID.
 func (c *CSAPI) JoinRoom(t *testing.T, roomIDOrAlias string, serverNames []string) string {
+	t.Helper()
+	return c.JoinRoomWithReason(t, roomIDOrAlias, "", serverNames)
+}
+
+// JoinRoomWithReason joins the room ID or alias given with an optional reason, else fails the test.
+// The reason is omitted from the request if it is empty. Returns the room ID.
+func (c *CSAPI) JoinRoomWithReason(t *testing.T, roomIDOrAlias, reason string, serverNames []string) string {
 	t.Helper()
 	// construct URL query parameters
 	query := make(url.Values, len(serverNames))
 	for _, serverName := range serverNames {
 		query.Add("server_name", serverName)
 	}
+	reqBody := map[string]interface{}{}
+	if reason != "" {
+		reqBody["reason"] = reason
+	}
 	// join the room
 	res := c.MustDoFunc(
 		t, "POST", []string{"_matrix", "client", "v3", "join", roomIDOrAlias},
-		WithQueries(query), WithJSONBody(t, map[string]interface{}{}),
+		WithQueries(query), WithJSONBody(t, reqBody),
 	)
 	// return the room ID if we joined with it
 	if roomIDOrAlias[0] == '!' {
@@ -155,6 +245,63 @@ func (c *CSAPI) JoinRoom(t *testing.T, roomIDOrAlias string, serverNames []strin
 	return GetJSONFieldStr(t, body, "room_id")
 }
 
+// JoinRemoteRoomSynced joins a room on another homeserver via the given `viaServers`, which are sent as
+// `server_name` query parameters, then waits for the join to come down /sync. Returns the room ID.
+func (c *CSAPI) JoinRemoteRoomSynced(t *testing.T, roomIDOrAlias string, viaServers []string) string {
+	t.Helper()
+	roomID := c.JoinRoom(t, roomIDOrAlias, viaServers)
+	c.MustSyncUntil(t, SyncReq{}, SyncRemoteUserJoined(roomID, c.UserID))
+	return roomID
+}
+
+// JoinRestrictedRoom joins the restricted room `roomID` via `servers`, relying on the client's membership of
+// `viaAllowedRoomID`, then waits until the join comes down /sync. Fails the test unless the room's join rules
+// allow members of `viaAllowedRoomID` to join and the join event has `join_authorised_via_users_server` set,
+// as required for restricted joins in room versions 8 and above. Returns the user ID which authorised the join.
+func (c *CSAPI) JoinRestrictedRoom(t *testing.T, roomID string, viaAllowedRoomID string, servers []string) string {
+	t.Helper()
+	c.JoinRoom(t, roomID, servers)
+	var authorisingUserID string
+	c.MustSyncUntil(
+		t, SyncReq{},
+		SyncJoinRulesAllows(roomID, viaAllowedRoomID),
+		SyncJoinedTo(c.UserID, roomID, func(ev gjson.Result) bool {
+			authorisingUserID = ev.Get("content.join_authorised_via_users_server").Str
+			return authorisingUserID != ""
+		}),
+	)
+	return authorisingUserID
+}
+
+// CreateAndJoin creates a public room as `creator`, then invites and joins each of the `joiners`.
+// Returns once every client, including the creator, has seen every joiner join the room down /sync.
+// Returns the room ID.
+func CreateAndJoin(t *testing.T, creator *CSAPI, joiners ...*CSAPI) (roomID string) {
+	t.Helper()
+	roomID = creator.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	checks := make([]SyncCheckOpt, 0, len(joiners))
+	for _, joiner := range joiners {
+		InviteAndJoin(t, creator, joiner, roomID)
+		checks = append(checks, SyncJoinedTo(joiner.UserID, roomID))
+	}
+	for _, c := range append([]*CSAPI{creator}, joiners...) {
+		c.MustSyncUntil(t, SyncReq{}, checks...)
+	}
+	return roomID
+}
+
+// InviteAndJoin invites `invitee` to `roomID` as `inviter`, waits for the invite to arrive, then joins
+// the room as `invitee`. Returns once the invitee has seen their own join down /sync.
+func InviteAndJoin(t *testing.T, inviter, invitee *CSAPI, roomID string) {
+	t.Helper()
+	inviter.InviteRoom(t, roomID, invitee.UserID)
+	invitee.MustSyncUntil(t, SyncReq{}, SyncInvitedTo(invitee.UserID, roomID))
+	invitee.JoinRoom(t, roomID, nil)
+	invitee.MustSyncUntil(t, SyncReq{}, SyncJoinedTo(invitee.UserID, roomID))
+}
+
 // LeaveRoom leaves the room ID, else fails the test.
 func (c *CSAPI) LeaveRoom(t *testing.T, roomID string) {
 	t.Helper()
@@ -173,6 +320,31 @@ func (c *CSAPI) InviteRoom(t *testing.T, roomID string, userID string) {
 	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "invite"}, WithJSONBody(t, body))
 }
 
+// MustSetDirectoryVisibilityAndWait publishes the room ID to the room directory, then polls
+// /publicRooms until the room is listed. Fails the test if the room is not listed after
+// CSAPI.SyncUntilTimeout.
+func (c *CSAPI) MustSetDirectoryVisibilityAndWait(t *testing.T, roomID string) {
+	t.Helper()
+	c.MustDoFunc(
+		t, "PUT", []string{"_matrix", "client", "v3", "directory", "list", "room", roomID},
+		WithJSONBody(t, map[string]interface{}{
+			"visibility": "public",
+		}),
+	)
+	c.Eventually(t, c.SyncUntilTimeout, func() error {
+		res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "publicRooms"})
+		body := ParseJSON(t, res)
+		var seen []string
+		for _, room := range gjson.GetBytes(body, "chunk").Array() {
+			if room.Get("room_id").Str == roomID {
+				return nil
+			}
+			seen = append(seen, room.Get("room_id").Str)
+		}
+		return fmt.Errorf("room %s not in /publicRooms, saw %v", roomID, seen)
+	})
+}
+
 func (c *CSAPI) GetGlobalAccountData(t *testing.T, eventType string) *http.Response {
 	return c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "user", c.UserID, "account_data", eventType})
 }
@@ -181,6 +353,53 @@ func (c *CSAPI) SetGlobalAccountData(t *testing.T, eventType string, content map
 	return c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "user", c.UserID, "account_data", eventType}, WithJSONBody(t, content))
 }
 
+// AddRoomToDirect marks `roomID` as a direct message room with `userID` by adding it to the user's
+// `m.direct` global account data. Existing entries are preserved. Fails the test on error.
+func (c *CSAPI) AddRoomToDirect(t *testing.T, userID, roomID string) {
+	t.Helper()
+	content := map[string]interface{}{}
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "v3", "user", c.UserID, "account_data", "m.direct"})
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		// no DMs yet, start from scratch
+		res.Body.Close()
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		if err := json.Unmarshal(ParseJSON(t, res), &content); err != nil {
+			t.Fatalf("AddRoomToDirect: failed to unmarshal m.direct: %s", err)
+		}
+	default:
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("AddRoomToDirect: fetching m.direct returned non-2xx code: %s - body: %s", res.Status, string(body))
+	}
+	rooms, _ := content[userID].([]interface{})
+	for _, r := range rooms {
+		if r == roomID {
+			return
+		}
+	}
+	content[userID] = append(rooms, roomID)
+	c.SetGlobalAccountData(t, "m.direct", content)
+}
+
+// SetGlobalAccountDataAndWait sets the global account data event of type `eventType` to `content`, then
+// syncs until the event comes down /sync with the same content.
+func (c *CSAPI) SetGlobalAccountDataAndWait(t *testing.T, eventType string, content interface{}) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "user", c.UserID, "account_data", eventType}, WithJSONBody(t, content))
+	b, err := json.Marshal(content)
+	if err != nil {
+		t.Fatalf("SetGlobalAccountDataAndWait: failed to marshal content: %s", err)
+	}
+	var wantContent interface{}
+	if err = json.Unmarshal(b, &wantContent); err != nil {
+		t.Fatalf("SetGlobalAccountDataAndWait: failed to unmarshal content: %s", err)
+	}
+	c.MustSyncUntil(t, SyncReq{}, SyncGlobalAccountDataHasType(eventType, func(gotContent gjson.Result) bool {
+		return reflect.DeepEqual(gotContent.Value(), wantContent)
+	}))
+}
+
 func (c *CSAPI) GetRoomAccountData(t *testing.T, roomID string, eventType string) *http.Response {
 	return c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "user", c.UserID, "rooms", roomID, "account_data", eventType})
 }
@@ -265,15 +484,23 @@ func (c *CSAPI) SetPushRule(t *testing.T, scope string, kind string, ruleID stri
 // Returns the event ID of the sent event.
 func (c *CSAPI) SendEventUnsynced(t *testing.T, roomID string, e b.Event) string {
 	t.Helper()
-	txnID := int(atomic.AddInt64(&c.txnID, 1))
-	paths := []string{"_matrix", "client", "v3", "rooms", roomID, "send", e.Type, strconv.Itoa(txnID)}
-	if e.StateKey != nil {
-		paths = []string{"_matrix", "client", "v3", "rooms", roomID, "state", e.Type, *e.StateKey}
+	return c.putEvent(t, roomID, e.Type, e.StateKey, e.Content)
+}
+
+// putEvent PUTs `content` to /state if `stateKey` is set, else to /send with a new transaction ID.
+// Fails the test on non-2xx. Returns the event ID of the sent event.
+func (c *CSAPI) putEvent(t *testing.T, roomID, eventType string, stateKey *string, content interface{}) string {
+	t.Helper()
+	var paths []string
+	if stateKey != nil {
+		paths = []string{"_matrix", "client", "v3", "rooms", roomID, "state", eventType, *stateKey}
+	} else {
+		txnID := int(atomic.AddInt64(&c.txnID, 1))
+		paths = []string{"_matrix", "client", "v3", "rooms", roomID, "send", eventType, strconv.Itoa(txnID)}
 	}
-	res := c.MustDoFunc(t, "PUT", paths, WithJSONBody(t, e.Content))
+	res := c.MustDoFunc(t, "PUT", paths, WithJSONBody(t, content))
 	body := ParseJSON(t, res)
-	eventID := GetJSONFieldStr(t, body, "event_id")
-	return eventID
+	return GetJSONFieldStr(t, body, "event_id")
 }
 
 // SendEventSynced sends `e` into the room and waits for its event ID to come down /sync.
@@ -288,6 +515,192 @@ func (c *CSAPI) SendEventSynced(t *testing.T, roomID string, e b.Event) string {
 	return eventID
 }
 
+// SendEncryptedEvent sends an `m.room.encrypted` event into the room without waiting for it to come
+// down /sync. The `content` is sent verbatim, so it must already contain the ciphertext and
+// algorithm-specific fields. Returns the event ID of the sent event.
+func (c *CSAPI) SendEncryptedEvent(t *testing.T, roomID string, content interface{}) string {
+	t.Helper()
+	return c.putEvent(t, roomID, "m.room.encrypted", nil, content)
+}
+
+// SendStateEvent sends a state event into the room without waiting for it to come down /sync.
+// Returns the event ID of the sent event.
+func (c *CSAPI) SendStateEvent(t *testing.T, roomID, eventType, stateKey string, content interface{}) string {
+	t.Helper()
+	return c.putEvent(t, roomID, eventType, &stateKey, content)
+}
+
+// GetStateEvent fetches the full state event, including `sender`, `origin_server_ts` and `unsigned`,
+// for the given type and state key in `roomID`. Fails the test if the event does not exist.
+//
+// This uses the non-standard `format=event` query parameter. Servers which ignore it return just the
+// event content, in which case the event is looked up in the room's full state instead.
+func (c *CSAPI) GetStateEvent(t *testing.T, roomID, eventType, stateKey string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(
+		t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state", eventType, stateKey},
+		WithQueries(url.Values{"format": []string{"event"}}),
+	)
+	ev := gjson.ParseBytes(ParseJSON(t, res))
+	if ev.Get("type").Str == eventType && ev.Get("content").IsObject() {
+		return ev
+	}
+	// the server doesn't support format=event, so find the event in the full room state
+	res = c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state"})
+	for _, ev := range gjson.ParseBytes(ParseJSON(t, res)).Array() {
+		if ev.Get("type").Str == eventType && ev.Get("state_key").Str == stateKey {
+			return ev
+		}
+	}
+	t.Fatalf("GetStateEvent: %s with state key '%s' not found in the state of %s", eventType, stateKey, roomID)
+	return gjson.Result{}
+}
+
+// StateSnapshot is the full state of a room at the time it was fetched. Create one with CSAPI.StateSnapshot.
+type StateSnapshot struct {
+	events map[stateTuple]gjson.Result
+}
+
+type stateTuple struct {
+	eventType string
+	stateKey  string
+}
+
+// Get returns the state event with the given type and state key. The returned result does not exist
+// if there is no such event in the snapshot, which can be checked with `Exists()`.
+func (s StateSnapshot) Get(eventType, stateKey string) gjson.Result {
+	return s.events[stateTuple{eventType, stateKey}]
+}
+
+// StateSnapshot fetches the full state of `roomID` in a single request, so that tests which inspect many
+// state events avoid a round-trip per event. Fails the test on non-2xx.
+//
+// The snapshot is point-in-time: it is not refreshed when the room state changes. Call StateSnapshot
+// again to see newer state.
+func (c *CSAPI) StateSnapshot(t *testing.T, roomID string) StateSnapshot {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state"})
+	snapshot := StateSnapshot{
+		events: make(map[stateTuple]gjson.Result),
+	}
+	for _, ev := range gjson.ParseBytes(ParseJSON(t, res)).Array() {
+		snapshot.events[stateTuple{ev.Get("type").Str, ev.Get("state_key").Str}] = ev
+	}
+	return snapshot
+}
+
+// GetEventWithUnsigned fetches `eventID` in `roomID` as the client sees it, including the `unsigned` section.
+// Fails the test on non-2xx.
+//
+// The client-server API does not expose the event graph, but some servers include federation fields such as
+// `auth_events` and `prev_events` in the response, which can help when debugging auth rule and state
+// resolution tests. Tests must not rely on those fields being present.
+func (c *CSAPI) GetEventWithUnsigned(t *testing.T, roomID, eventID string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "event", eventID})
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// SetReadMarkerAndWaitForCountReset marks `roomID` as read up to `eventID` with MarkRoomAsRead, then syncs
+// until the room's unread notification and highlight counts are both zero.
+func (c *CSAPI) SetReadMarkerAndWaitForCountReset(t *testing.T, roomID, eventID string) {
+	t.Helper()
+	c.MarkRoomAsRead(t, roomID, eventID)
+	c.MustSyncUntil(t, SyncReq{}, SyncUnreadCountIs(roomID, 0, 0))
+}
+
+// SendTyping sets whether the client's user is typing in `roomID`. If `typing` is true, the server stops
+// the notification after `timeout` unless it is refreshed. Fails the test on non-2xx.
+func (c *CSAPI) SendTyping(t *testing.T, roomID string, typing bool, timeout time.Duration) {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"typing": typing,
+	}
+	if typing {
+		reqBody["timeout"] = timeout.Milliseconds()
+	}
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "rooms", roomID, "typing", c.UserID}, WithJSONBody(t, reqBody))
+}
+
+// TypeFor marks the client's user as typing in `roomID` for `d`, then explicitly stops typing. This blocks
+// for `d`. The typing timeout sent to the server is also `d`, so the notification does not linger if the
+// stop request is never made.
+func (c *CSAPI) TypeFor(t *testing.T, roomID string, d time.Duration) {
+	t.Helper()
+	c.SendTyping(t, roomID, true, d)
+	time.Sleep(d)
+	c.SendTyping(t, roomID, false, 0)
+}
+
+// Presence is the presence state of a user, as returned by GetPresenceTyped.
+type Presence struct {
+	Presence        string
+	StatusMsg       string
+	LastActiveAgo   int64
+	CurrentlyActive bool
+}
+
+// GetPresence fetches the presence state of `userID`. Fails the test on non-2xx.
+func (c *CSAPI) GetPresence(t *testing.T, userID string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "presence", userID, "status"})
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// GetPresenceTyped is the same as GetPresence but returns the presence state as a Presence. Optional
+// fields which are missing from the response are left as their zero value.
+func (c *CSAPI) GetPresenceTyped(t *testing.T, userID string) Presence {
+	t.Helper()
+	res := c.GetPresence(t, userID)
+	return Presence{
+		Presence:        res.Get("presence").Str,
+		StatusMsg:       res.Get("status_msg").Str,
+		LastActiveAgo:   res.Get("last_active_ago").Int(),
+		CurrentlyActive: res.Get("currently_active").Bool(),
+	}
+}
+
+// SetHistoryVisibility sets the `m.room.history_visibility` of `roomID` to `visibility`, which must be
+// one of "world_readable", "shared", "invited" or "joined". Returns the event ID of the state event.
+func (c *CSAPI) SetHistoryVisibility(t *testing.T, roomID, visibility string) string {
+	t.Helper()
+	switch visibility {
+	case "world_readable", "shared", "invited", "joined":
+	default:
+		t.Fatalf("SetHistoryVisibility: unknown history visibility %q", visibility)
+	}
+	return c.SendStateEvent(t, roomID, "m.room.history_visibility", "", map[string]interface{}{
+		"history_visibility": visibility,
+	})
+}
+
+// SetJoinRules sets the `m.room.join_rules` of `roomID` to `content`, which must contain at least a
+// `join_rule`. Returns the event ID of the state event.
+func (c *CSAPI) SetJoinRules(t *testing.T, roomID string, content interface{}) string {
+	t.Helper()
+	return c.SendStateEvent(t, roomID, "m.room.join_rules", "", content)
+}
+
+// SetServerACL sets the `m.room.server_acl` of `roomID` to `content`, which should contain the `allow`,
+// `deny` and `allow_ip_literals` fields. Returns the event ID of the state event.
+func (c *CSAPI) SetServerACL(t *testing.T, roomID string, content interface{}) string {
+	t.Helper()
+	return c.SendStateEvent(t, roomID, "m.room.server_acl", "", content)
+}
+
+// MarkRoomAsRead moves both the fully read marker and the read receipt in `roomID` to `eventID`,
+// which resets the room's unread notification and highlight counts. Fails the test on error.
+func (c *CSAPI) MarkRoomAsRead(t *testing.T, roomID, eventID string) {
+	t.Helper()
+	c.MustDoFunc(
+		t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "read_markers"},
+		WithJSONBody(t, map[string]interface{}{
+			"m.fully_read": eventID,
+			"m.read":       eventID,
+		}),
+	)
+}
+
 // SendRedaction sends a redaction request. Will fail if the returned HTTP request code is not 200
 func (c *CSAPI) SendRedaction(t *testing.T, roomID string, e b.Event, eventID string) string {
 	t.Helper()
@@ -298,6 +711,142 @@ func (c *CSAPI) SendRedaction(t *testing.T, roomID string, e b.Event, eventID st
 	return GetJSONFieldStr(t, body, "event_id")
 }
 
+// maxLatestEventPages is the number of pages of /messages MustGetLatestEventOfType will request
+// before giving up.
+const maxLatestEventPages = 10
+
+// MustGetLatestEventOfType paginates backwards through /messages in `roomID` from the most recent
+// event, returning the first event with the type `eventType`. Gives up and fails the test if no event
+// of this type is found within 10 pages of /messages.
+func (c *CSAPI) MustGetLatestEventOfType(t *testing.T, roomID, eventType string) gjson.Result {
+	t.Helper()
+	filter, err := json.Marshal(map[string]interface{}{
+		"types": []string{eventType},
+	})
+	if err != nil {
+		t.Fatalf("MustGetLatestEventOfType: failed to marshal filter: %s", err)
+	}
+	paginator := c.PaginateMessages(t, roomID, "b", 100).Filter(string(filter))
+	for page := 0; page < maxLatestEventPages; page++ {
+		events, ok := paginator.Next(t)
+		if !ok {
+			// we've reached the start of the room
+			break
+		}
+		for _, ev := range events {
+			if ev.Get("type").Str == eventType {
+				return ev
+			}
+		}
+	}
+	t.Fatalf("MustGetLatestEventOfType: no %s event found in %s", eventType, roomID)
+	return gjson.Result{}
+}
+
+// MessagesPaginator walks through the history of a room via /messages, tracking the pagination token
+// between calls. Create one with CSAPI.PaginateMessages.
+type MessagesPaginator struct {
+	c         *CSAPI
+	roomID    string
+	query     url.Values
+	exhausted bool
+}
+
+// PaginateMessages returns a MessagesPaginator for `roomID`. `dir` is "b" to paginate backwards from the
+// most recent event or "f" to paginate forwards from the start of the room. `pageSize` is the `limit` for
+// each request, and is omitted if not positive.
+//
+// Example of walking an entire room history:
+//
+//	paginator := alice.PaginateMessages(t, roomID, "b", 10)
+//	for events, ok := paginator.Next(t); ok; events, ok = paginator.Next(t) {
+//	  ...
+//	}
+func (c *CSAPI) PaginateMessages(t *testing.T, roomID, dir string, pageSize int) *MessagesPaginator {
+	t.Helper()
+	query := url.Values{
+		"dir": []string{dir},
+	}
+	if pageSize > 0 {
+		query.Set("limit", strconv.Itoa(pageSize))
+	}
+	return &MessagesPaginator{
+		c:      c,
+		roomID: roomID,
+		query:  query,
+	}
+}
+
+// From sets the token to start paginating from, e.g a `prev_batch` token from /sync. It must be called
+// before the first call to Next. Returns the paginator to allow chaining.
+func (p *MessagesPaginator) From(token string) *MessagesPaginator {
+	p.query.Set("from", token)
+	return p
+}
+
+// Filter sets the RoomEventFilter, encoded as JSON, to apply to each page. Returns the paginator to
+// allow chaining.
+func (p *MessagesPaginator) Filter(filter string) *MessagesPaginator {
+	p.query.Set("filter", filter)
+	return p
+}
+
+// Next fetches the next page of events. Returns false if there are no more pages, in which case no
+// request is made. Fails the test on non-2xx.
+func (p *MessagesPaginator) Next(t *testing.T) ([]gjson.Result, bool) {
+	t.Helper()
+	if p.exhausted {
+		return nil, false
+	}
+	res := p.c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", p.roomID, "messages"}, WithQueries(p.query))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	end := body.Get("end")
+	if end.Exists() {
+		p.query.Set("from", end.Str)
+	} else {
+		// this is the last page
+		p.exhausted = true
+	}
+	return body.Get("chunk").Array(), true
+}
+
+// CountTimelineEvents paginates backwards through /messages in `roomID`, returning the total number
+// of events seen. At most `maxPages` pages are requested, so this is only an estimate bounded by
+// `maxPages` multiplied by the server's page size: it is exact only if the start of the room is reached.
+func (c *CSAPI) CountTimelineEvents(t *testing.T, roomID string, maxPages int) int {
+	t.Helper()
+	count := 0
+	paginator := c.PaginateMessages(t, roomID, "b", 0)
+	for page := 0; page < maxPages; page++ {
+		events, ok := paginator.Next(t)
+		if !ok {
+			break
+		}
+		count += len(events)
+	}
+	return count
+}
+
+// GetThreads lists the thread roots in `roomID`. `include` may be "all" or "participated", `from` is
+// a `next_batch` token from a previous call and `limit` is the maximum number of threads to return.
+// Empty strings and a non-positive limit are omitted from the request. Fails the test on non-2xx.
+// Returns the full response, including `chunk` and `next_batch`.
+func (c *CSAPI) GetThreads(t *testing.T, roomID, include, from string, limit int) gjson.Result {
+	t.Helper()
+	query := url.Values{}
+	if include != "" {
+		query.Set("include", include)
+	}
+	if from != "" {
+		query.Set("from", from)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v1", "rooms", roomID, "threads"}, WithQueries(query))
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
 // Perform a single /sync request with the given request options. To sync until something happens,
 // see `MustSyncUntil`.
 //
@@ -308,6 +857,9 @@ func (c *CSAPI) MustSync(t *testing.T, syncReq SyncReq) (gjson.Result, string) {
 	query := url.Values{
 		"timeout": []string{"1000"},
 	}
+	if c.DefaultSyncTimeoutMillis != "" {
+		query["timeout"] = []string{c.DefaultSyncTimeoutMillis}
+	}
 	// configure the HTTP request based on SyncReq
 	if syncReq.TimeoutMillis != "" {
 		query["timeout"] = []string{syncReq.TimeoutMillis}
@@ -414,6 +966,119 @@ func (c *CSAPI) MustSyncUntil(t *testing.T, syncReq SyncReq, checks ...SyncCheck
 	}
 }
 
+// MustNotSyncUntil is the inverse of MustSyncUntil: it syncs repeatedly for `timeout`, failing the test
+// as soon as `check` passes on any /sync response. The check never passing within the window is the
+// success condition, so keep `timeout` as short as the test allows. Returns the `next_batch` token
+// from the final response.
+func (c *CSAPI) MustNotSyncUntil(t *testing.T, timeout time.Duration, syncReq SyncReq, check SyncCheckOpt) string {
+	t.Helper()
+	start := time.Now()
+	numResponsesReturned := 0
+	for time.Since(start) < timeout {
+		response, nextBatch := c.MustSync(t, syncReq)
+		syncReq.Since = nextBatch
+		numResponsesReturned += 1
+		if err := check(c.UserID, response); err == nil {
+			t.Fatalf("%s MustNotSyncUntil: check unexpectedly passed on /sync response #%d after %v", c.UserID, numResponsesReturned, time.Since(start))
+		}
+	}
+	return syncReq.Since
+}
+
+// MustNotSeeEventInTimeline asserts that `eventID` does not appear in the timeline of `roomID` for this
+// client within `timeout`. This is the assertion to use when testing that an event has not leaked to a
+// user, e.g because of history visibility or permissions. The event being absent for the whole window
+// is the success condition.
+func (c *CSAPI) MustNotSeeEventInTimeline(t *testing.T, timeout time.Duration, roomID, eventID string) {
+	t.Helper()
+	c.MustNotSyncUntil(t, timeout, SyncReq{}, SyncTimelineHasEventID(roomID, eventID))
+}
+
+// MustSyncUntilGappyAndBackfill syncs until the timeline for `roomID` is limited, then backfills into the
+// gap by calling /messages backwards from the timeline's `prev_batch` token, returning up to `limit`
+// backfilled events in reverse chronological order. This mirrors how a client recovers from a gappy sync.
+func (c *CSAPI) MustSyncUntilGappyAndBackfill(t *testing.T, syncReq SyncReq, roomID string, limit int) []gjson.Result {
+	t.Helper()
+	var prevBatch string
+	c.MustSyncUntil(t, syncReq, func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		if err := SyncTimelineLimited(roomID)(clientUserID, topLevelSyncJSON); err != nil {
+			return err
+		}
+		prevBatch = GetTimelinePrevBatch(t, topLevelSyncJSON, roomID)
+		return nil
+	})
+	paginator := c.PaginateMessages(t, roomID, "b", limit).From(prevBatch)
+	events, _ := paginator.Next(t)
+	return events
+}
+
+// SyncUntilDeviceListsStable syncs until device lists have settled, returning the `next_batch` token of the
+// final response. Device lists are considered settled once two consecutive /sync responses have no entries in
+// `device_lists.changed`. This is a heuristic: a single empty response may just mean an update is still in
+// flight. Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilDeviceListsStable(t *testing.T, req SyncReq) string {
+	t.Helper()
+	start := time.Now()
+	emptyResponses := 0
+	for emptyResponses < 2 {
+		if time.Since(start) > c.SyncUntilTimeout {
+			t.Fatalf("%s SyncUntilDeviceListsStable: timed out after %v", c.UserID, time.Since(start))
+		}
+		response, nextBatch := c.MustSync(t, req)
+		req.Since = nextBatch
+		if len(response.Get("device_lists.changed").Array()) == 0 {
+			emptyResponses++
+		} else {
+			emptyResponses = 0
+		}
+	}
+	return req.Since
+}
+
+// MustSyncUntilTimelineHasInBoth syncs until `eventA` is in the timeline of `roomA` and `eventB` is in the
+// timeline of `roomB`. The events may arrive in the same or different /sync responses, in any order.
+// Returns the `next_batch` token from the final response.
+func (c *CSAPI) MustSyncUntilTimelineHasInBoth(t *testing.T, req SyncReq, roomA, eventA, roomB, eventB string) string {
+	t.Helper()
+	return c.MustSyncUntil(t, req, SyncTimelineHasEventID(roomA, eventA), SyncTimelineHasEventID(roomB, eventB))
+}
+
+// CurrentOTKCount returns the number of one-time keys of type `algorithm` the server holds for this device,
+// as reported in `device_one_time_keys_count` of an immediate /sync. Returns 0 if the server omits the count.
+// Use with SyncOTKCount to wait for the count to change after keys are claimed.
+func (c *CSAPI) CurrentOTKCount(t *testing.T, algorithm string) int {
+	t.Helper()
+	response, _ := c.MustSync(t, SyncReq{TimeoutMillis: "0"})
+	return int(response.Get("device_one_time_keys_count." + GjsonEscape(algorithm)).Int())
+}
+
+// SyncUntilEventAndReturnToken syncs until `eventID` appears in the timeline of `roomID`, returning the
+// `next_batch` token of the response which contained the event. An incremental /sync from this token will
+// only return events after `eventID`.
+func (c *CSAPI) SyncUntilEventAndReturnToken(t *testing.T, req SyncReq, roomID, eventID string) string {
+	t.Helper()
+	return c.MustSyncUntil(t, req, SyncTimelineHasEventID(roomID, eventID))
+}
+
+// Eventually calls `fn` repeatedly until it returns nil, failing the test with the last error
+// returned if `fn` has not succeeded after `timeout`. This is useful for asserting on eventually
+// consistent APIs such as the room directory, alias resolution and profile lookups over federation.
+func (c *CSAPI) Eventually(t *testing.T, timeout time.Duration, fn func() error) {
+	t.Helper()
+	start := time.Now()
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		if time.Since(start) > timeout {
+			t.Fatalf("%s Eventually: timed out after %v. Last error: %s", c.UserID, time.Since(start), err)
+		}
+		// small sleep to avoid tight-looping
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 // LoginUser will log in to a homeserver and create a new device on an existing user.
 func (c *CSAPI) LoginUser(t *testing.T, localpart, password string) (userID, accessToken, deviceID string) {
 	t.Helper()
@@ -462,13 +1127,99 @@ func (c *CSAPI) RegisterUser(t *testing.T, localpart, password string) (userID,
 	return userID, accessToken, deviceID
 }
 
-// RegisterSharedSecret registers a new account with a shared secret via HMAC
-// See https://github.com/matrix-org/synapse/blob/e550ab17adc8dd3c48daf7fedcd09418a73f524b/synapse/_scripts/register_new_matrix_user.py#L40
-func (c *CSAPI) RegisterSharedSecret(t *testing.T, user, pass string, isAdmin bool) (userID, accessToken, deviceID string) {
-	resp := c.DoFunc(t, "GET", []string{"_synapse", "admin", "v1", "register"})
-	if resp.StatusCode != 200 {
-		t.Skipf("Homeserver image does not support shared secret registration, /_synapse/admin/v1/register returned HTTP %d", resp.StatusCode)
-		return
+// RegisterUserWithDisplayName registers the user with given parameters, then sets their display name
+// using the access token returned by registration. Fails the test on error.
+func (c *CSAPI) RegisterUserWithDisplayName(t *testing.T, localpart, password, displayName string) (userID, accessToken string) {
+	t.Helper()
+	userID, accessToken, _ = c.RegisterUser(t, localpart, password)
+	authed := &CSAPI{
+		UserID:            userID,
+		AccessToken:       accessToken,
+		BaseURL:           c.BaseURL,
+		Client:            c.Client,
+		SyncUntilTimeout:  c.SyncUntilTimeout,
+		Debug:             c.Debug,
+		UseQueryToken:     c.UseQueryToken,
+		RequestMiddleware: c.RequestMiddleware,
+	}
+	authed.SetDisplayName(t, displayName)
+	return userID, accessToken
+}
+
+// SetDisplayName sets the display name of the client's user. Fails the test on error.
+//
+// The new display name is propagated to the user's membership events in every room they are joined to,
+// which other users can wait for with SyncMemberDisplayNameIs.
+func (c *CSAPI) SetDisplayName(t *testing.T, displayName string) {
+	t.Helper()
+	c.SetProfileField(t, "displayname", displayName)
+}
+
+// GetProfileField fetches the profile field `field` of `userID`, e.g "displayname", "avatar_url" or a
+// custom extended profile field. Fails the test on non-2xx. Returns the value of the field.
+func (c *CSAPI) GetProfileField(t *testing.T, userID, field string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "profile", userID, field})
+	return gjson.GetBytes(ParseJSON(t, res), GjsonEscape(field))
+}
+
+// SetProfileField sets the profile field `field` of the client's user to `value`. Fails the test on non-2xx.
+func (c *CSAPI) SetProfileField(t *testing.T, field string, value interface{}) {
+	t.Helper()
+	c.MustDoFunc(
+		t, "PUT", []string{"_matrix", "client", "v3", "profile", c.UserID, field},
+		WithJSONBody(t, map[string]interface{}{
+			field: value,
+		}),
+	)
+}
+
+// RegisterAppServiceUser registers a user in the application service's namespace using the
+// `m.login.application_service` login type. The client must be using the application service's
+// `as_token` as its access token. Fails the test on non-2xx. Returns the user ID.
+func (c *CSAPI) RegisterAppServiceUser(t *testing.T, localpart string) (userID string) {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"type":     "m.login.application_service",
+		"username": localpart,
+	}
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "register"}, WithJSONBody(t, reqBody))
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "user_id")
+}
+
+// RegisterGuest registers a guest account via `?kind=guest`. If the server responds with a
+// user-interactive auth challenge, the request is retried with `m.login.dummy` auth. Fails the test
+// on non-2xx. Returns the guest's user ID and access token.
+func (c *CSAPI) RegisterGuest(t *testing.T) (userID, accessToken string) {
+	t.Helper()
+	paths := []string{"_matrix", "client", "v3", "register"}
+	query := WithQueries(url.Values{"kind": []string{"guest"}})
+	res := c.DoFunc(t, "POST", paths, WithJSONBody(t, map[string]interface{}{}), query)
+	if res.StatusCode == http.StatusUnauthorized {
+		session := gjson.GetBytes(ParseJSON(t, res), "session").Str
+		res = c.MustDoFunc(t, "POST", paths, query, WithJSONBody(t, map[string]interface{}{
+			"auth": map[string]string{
+				"type":    "m.login.dummy",
+				"session": session,
+			},
+		}))
+	} else if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("CSAPI.RegisterGuest returned non-2xx code: %s - body: %s", res.Status, string(body))
+	}
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "user_id"), GetJSONFieldStr(t, body, "access_token")
+}
+
+// RegisterSharedSecret registers a new account with a shared secret via HMAC
+// See https://github.com/matrix-org/synapse/blob/e550ab17adc8dd3c48daf7fedcd09418a73f524b/synapse/_scripts/register_new_matrix_user.py#L40
+func (c *CSAPI) RegisterSharedSecret(t *testing.T, user, pass string, isAdmin bool) (userID, accessToken, deviceID string) {
+	resp := c.DoFunc(t, "GET", []string{"_synapse", "admin", "v1", "register"})
+	if resp.StatusCode != 200 {
+		t.Skipf("Homeserver image does not support shared secret registration, /_synapse/admin/v1/register returned HTTP %d", resp.StatusCode)
+		return
 	}
 	body := must.ParseJSON(t, resp.Body)
 	nonce := gjson.GetBytes(body, "nonce")
@@ -503,6 +1254,62 @@ func (c *CSAPI) RegisterSharedSecret(t *testing.T, user, pass string, isAdmin bo
 	return userID, accessToken, deviceID
 }
 
+// GetWellKnown queries the server's client discovery information at /.well-known/matrix/client and
+// returns the parsed JSON. Fails the test if the server does not serve this file.
+func (c *CSAPI) GetWellKnown(t *testing.T) gjson.Result {
+	t.Helper()
+	res := c.DoFuncURL(t, "GET", c.BaseURL+"/.well-known/matrix/client")
+	if res.StatusCode == http.StatusNotFound {
+		t.Fatalf("CSAPI.GetWellKnown: server returned 404, /.well-known/matrix/client is not configured")
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("CSAPI.GetWellKnown returned non-2xx code: %s - body: %s", res.Status, string(body))
+	}
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// GetVersions queries the spec versions and unstable features supported by the server. The
+// request is made without an access token as /versions is a public endpoint.
+func (c *CSAPI) GetVersions(t *testing.T) (versions []string, unstableFeatures map[string]bool) {
+	t.Helper()
+	unauthed := &CSAPI{
+		BaseURL:           c.BaseURL,
+		Client:            c.Client,
+		SyncUntilTimeout:  c.SyncUntilTimeout,
+		Debug:             c.Debug,
+		RequestMiddleware: c.RequestMiddleware,
+	}
+	res := unauthed.MustDoFunc(t, "GET", []string{"_matrix", "client", "versions"})
+	body := ParseJSON(t, res)
+	versions = GetJSONFieldStringArray(t, body, "versions")
+	unstableFeatures = make(map[string]bool)
+	gjson.GetBytes(body, "unstable_features").ForEach(func(key, value gjson.Result) bool {
+		unstableFeatures[key.Str] = value.Bool()
+		return true
+	})
+	return versions, unstableFeatures
+}
+
+// HasUnstableFeature returns true if the server advertises `feature` as enabled in the
+// `unstable_features` section of /versions.
+func (c *CSAPI) HasUnstableFeature(t *testing.T, feature string) bool {
+	t.Helper()
+	_, unstableFeatures := c.GetVersions(t)
+	return unstableFeatures[feature]
+}
+
+// MustHaveUnstableFeature skips the test if the server does not advertise `feature` as enabled in
+// the `unstable_features` section of /versions. Use this to gate tests for MSCs which not all
+// servers implement.
+func (c *CSAPI) MustHaveUnstableFeature(t *testing.T, feature string) {
+	t.Helper()
+	if !c.HasUnstableFeature(t, feature) {
+		t.Skipf("Homeserver does not advertise unstable feature %s", feature)
+	}
+}
+
 // GetCapbabilities queries the server's capabilities
 func (c *CSAPI) GetCapabilities(t *testing.T) []byte {
 	t.Helper()
@@ -563,13 +1370,25 @@ func WithJSONBody(t *testing.T, obj interface{}) RequestOpt {
 
 // WithQueries sets the query parameters on the request.
 // This function should not be used to set an "access_token" parameter for Matrix authentication.
-// Instead, set CSAPI.AccessToken.
+// Instead, set CSAPI.AccessToken and, if needed, CSAPI.UseQueryToken.
 func WithQueries(q url.Values) RequestOpt {
 	return func(req *http.Request) {
 		req.URL.RawQuery = q.Encode()
 	}
 }
 
+// WithMasqueradeUser sets the "user_id" query parameter on the request, keeping any existing query
+// parameters. This allows an application service to act as one of the users in its namespace, and
+// so must be used with a client whose access token is the application service's `as_token`.
+// As WithQueries replaces all query parameters, this option must come after it.
+func WithMasqueradeUser(userID string) RequestOpt {
+	return func(req *http.Request) {
+		q := req.URL.Query()
+		q.Set("user_id", userID)
+		req.URL.RawQuery = q.Encode()
+	}
+}
+
 // WithRetryUntil will retry the request until the provided function returns true. Times out after
 // `timeout`, which will then fail the test.
 func WithRetryUntil(timeout time.Duration, untilFn func(res *http.Response) bool) RequestOpt {
@@ -592,6 +1411,59 @@ func (c *CSAPI) MustDoFunc(t *testing.T, method string, paths []string, opts ...
 	return res
 }
 
+// MustDoFuncWithin is the same as MustDoFunc but also fails the test if the HTTP exchange takes longer
+// than `budget`. Only the round-trip is timed, as measured by the logged client's transport, so time
+// spent building the request or reading the response body is not counted. If the request is retried,
+// only the final attempt is timed. Clients which do not use NewLoggedClient fall back to timing the
+// whole call.
+func (c *CSAPI) MustDoFuncWithin(t *testing.T, budget time.Duration, method string, paths []string, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	start := time.Now()
+	res := c.MustDoFunc(t, method, paths, opts...)
+	elapsed := time.Since(start)
+	if duration, ok := res.Request.Context().Value(CtxKeyRoundTripDuration).(*time.Duration); ok && *duration > 0 {
+		elapsed = *duration
+	}
+	if elapsed > budget {
+		t.Fatalf("CSAPI.MustDoFuncWithin %s %s took %v, exceeding the budget of %v", method, res.Request.URL.String(), elapsed, budget)
+	}
+	return res
+}
+
+// MustDoFuncJSON is the same as MustDoFunc but also reads, validates and closes the JSON response body,
+// returning it parsed alongside the response. The response body is replaced with a copy of what was read,
+// so it is still safe to read it again.
+func (c *CSAPI) MustDoFuncJSON(t *testing.T, method string, paths []string, opts ...RequestOpt) (*http.Response, gjson.Result) {
+	t.Helper()
+	res := c.MustDoFunc(t, method, paths, opts...)
+	body := ParseJSON(t, res)
+	res.Body = io.NopCloser(bytes.NewBuffer(body))
+	return res, gjson.ParseBytes(body)
+}
+
+// MustDoHead performs a HEAD request and returns the response headers. Fails the test if the returned
+// HTTP response code is not 2xx. Useful for asserting on headers such as Content-Type without fetching
+// the response body.
+func (c *CSAPI) MustDoHead(t *testing.T, paths []string, opts ...RequestOpt) http.Header {
+	t.Helper()
+	res := c.MustDoFunc(t, "HEAD", paths, opts...)
+	res.Body.Close()
+	return res.Header
+}
+
+// MustDoFuncStatus is the same as DoFunc but fails the test if the returned HTTP response code is not
+// exactly `wantStatus`.
+func (c *CSAPI) MustDoFuncStatus(t *testing.T, wantStatus int, method string, paths []string, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	res := c.DoFunc(t, method, paths, opts...)
+	if res.StatusCode != wantStatus {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("CSAPI.MustDoFuncStatus %s %s returned code %s, want %d - body: %s", method, res.Request.URL.String(), res.Status, wantStatus, string(body))
+	}
+	return res
+}
+
 // DoFunc performs an arbitrary HTTP request to the server. This function supports RequestOpts to set
 // extra information on the request such as an HTTP request body, query parameters and content-type.
 // See all functions in this package starting with `With...`.
@@ -610,19 +1482,31 @@ func (c *CSAPI) DoFunc(t *testing.T, method string, paths []string, opts ...Requ
 		paths[i] = url.PathEscape(paths[i])
 	}
 	reqURL := c.BaseURL + "/" + strings.Join(paths, "/")
-	req, err := http.NewRequest(method, reqURL, nil)
+	return c.DoFuncURL(t, method, reqURL, opts...)
+}
+
+// DoFuncURL is the same as DoFunc but performs the HTTP request to the absolute URL `fullURL`
+// rather than joining path segments onto the BaseURL. Path segments are not escaped, so this
+// can be used to hit endpoints outside the `_matrix` prefix such as `/.well-known/matrix/client`.
+func (c *CSAPI) DoFuncURL(t *testing.T, method, fullURL string, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, fullURL, nil)
 	if err != nil {
 		t.Fatalf("CSAPI.DoFunc failed to create http.NewRequest: %s", err)
 	}
 	// set defaults before RequestOpts
-	if c.AccessToken != "" {
+	if c.AccessToken != "" && !c.UseQueryToken {
 		req.Header.Set("Authorization", "Bearer "+c.AccessToken)
 	}
 	retryUntil := &retryUntilParams{}
 	ctx := context.WithValue(req.Context(), CtxKeyWithRetryUntil, retryUntil)
+	ctx = context.WithValue(ctx, CtxKeyRoundTripDuration, new(time.Duration))
 	req = req.WithContext(ctx)
 
-	// set functional options
+	// set middleware, then functional options
+	for _, o := range c.RequestMiddleware {
+		o(req)
+	}
 	for _, o := range opts {
 		o(req)
 	}
@@ -630,6 +1514,12 @@ func (c *CSAPI) DoFunc(t *testing.T, method string, paths []string, opts ...Requ
 	if req.Header.Get("Content-Type") == "" {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	// this is done after RequestOpts as WithQueries replaces the query string
+	if c.AccessToken != "" && c.UseQueryToken {
+		q := req.URL.Query()
+		q.Set("access_token", c.AccessToken)
+		req.URL.RawQuery = q.Encode()
+	}
 	// debug log the request
 	if c.Debug {
 		t.Logf("Making %s request to %s (%s)", method, req.URL, c.AccessToken)
@@ -713,6 +1603,9 @@ type loggedRoundTripper struct {
 func (t *loggedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := time.Now()
 	res, err := t.wrap.RoundTrip(req)
+	if duration, ok := req.Context().Value(CtxKeyRoundTripDuration).(*time.Duration); ok {
+		*duration = time.Since(start)
+	}
 	if err != nil {
 		t.t.Logf("[CSAPI] %s %s%s => error: %s (%s)", req.Method, t.hsName, req.URL.Path, err, time.Since(start))
 	} else {
@@ -734,6 +1627,58 @@ func GetJSONFieldStr(t *testing.T, body []byte, wantKey string) string {
 	return res.Str
 }
 
+// GetJSONFieldInt extracts an integer from a byte-encoded JSON body given a search key
+func GetJSONFieldInt(t *testing.T, body []byte, wantKey string) int64 {
+	t.Helper()
+	res := gjson.GetBytes(body, wantKey)
+	if !res.Exists() {
+		t.Fatalf("JSONFieldInt: key '%s' missing from %s", wantKey, string(body))
+	}
+	if res.Type != gjson.Number {
+		t.Fatalf("JSONFieldInt: key '%s' is not a number, body: %s", wantKey, string(body))
+	}
+	return res.Int()
+}
+
+// GetJSONFieldFloat extracts a floating point number from a byte-encoded JSON body given a search key
+func GetJSONFieldFloat(t *testing.T, body []byte, wantKey string) float64 {
+	t.Helper()
+	res := gjson.GetBytes(body, wantKey)
+	if !res.Exists() {
+		t.Fatalf("JSONFieldFloat: key '%s' missing from %s", wantKey, string(body))
+	}
+	if res.Type != gjson.Number {
+		t.Fatalf("JSONFieldFloat: key '%s' is not a number, body: %s", wantKey, string(body))
+	}
+	return res.Num
+}
+
+// GetJSONFieldBool extracts a boolean from a byte-encoded JSON body given a search key
+func GetJSONFieldBool(t *testing.T, body []byte, wantKey string) bool {
+	t.Helper()
+	res := gjson.GetBytes(body, wantKey)
+	if !res.Exists() {
+		t.Fatalf("JSONFieldBool: key '%s' missing from %s", wantKey, string(body))
+	}
+	if res.Type != gjson.True && res.Type != gjson.False {
+		t.Fatalf("JSONFieldBool: key '%s' is not a boolean, body: %s", wantKey, string(body))
+	}
+	return res.Bool()
+}
+
+// GetJSONFieldObject extracts a JSON object from a byte-encoded JSON body given a search key
+func GetJSONFieldObject(t *testing.T, body []byte, wantKey string) gjson.Result {
+	t.Helper()
+	res := gjson.GetBytes(body, wantKey)
+	if !res.Exists() {
+		t.Fatalf("JSONFieldObject: key '%s' missing from %s", wantKey, string(body))
+	}
+	if !res.IsObject() {
+		t.Fatalf("JSONFieldObject: key '%s' is not an object, body: %s", wantKey, string(body))
+	}
+	return res
+}
+
 func GetJSONFieldStringArray(t *testing.T, body []byte, wantKey string) []string {
 	t.Helper()
 
@@ -771,11 +1716,26 @@ func ParseJSON(t *testing.T, res *http.Response) []byte {
 	return body
 }
 
-// GjsonEscape escapes . and * from the input so it can be used with gjson.Get
+// GjsonEscape escapes characters which have a special meaning in gjson paths (such as ., *, ?, #, |
+// and @) from the input so it can be used as a single key with gjson.Get
 func GjsonEscape(in string) string {
-	in = strings.ReplaceAll(in, ".", `\.`)
-	in = strings.ReplaceAll(in, "*", `\*`)
-	return in
+	var sb strings.Builder
+	sb.Grow(len(in))
+	for i := 0; i < len(in); i++ {
+		if !isSafeGjsonKeyChar(in[i]) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(in[i])
+	}
+	return sb.String()
+}
+
+// isSafeGjsonKeyChar returns true if `c` can appear unescaped in a gjson path key. This mirrors
+// the set of characters gjson itself considers safe.
+func isSafeGjsonKeyChar(c byte) bool {
+	return c <= ' ' || c > '~' || c == '_' || c == '-' || c == ':' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9')
 }
 
 // Check that the timeline for `roomID` has an event which passes the check function.
@@ -798,6 +1758,117 @@ func SyncTimelineHasEventID(roomID string, eventID string) SyncCheckOpt {
 	})
 }
 
+// Check that the timeline for `roomID` has at least `min` events which pass the check function.
+//
+// Note: each /sync response is checked on its own, and an incremental /sync only contains the events
+// since the previous response. Counts are not accumulated across responses, so use this with a /sync
+// whose timeline covers all the expected events, e.g. an initial sync with a large enough timeline limit.
+func SyncTimelineHasCount(roomID string, check func(gjson.Result) bool, min int) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		count := 0
+		for _, ev := range topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID) + ".timeline.events").Array() {
+			if check(ev) {
+				count++
+			}
+		}
+		if count < min {
+			return fmt.Errorf("SyncTimelineHasCount(%s): %d events passed the check function, want at least %d", roomID, count, min)
+		}
+		return nil
+	}
+}
+
+// Check that the timeline for `roomID` has an event which relates to `relatesToEventID` with the relation
+// type `relType`, e.g "m.annotation" for reactions or "m.replace" for edits.
+func SyncTimelineHasRelation(roomID, relType, relatesToEventID string) SyncCheckOpt {
+	return SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+		relatesTo := ev.Get(`content.m\.relates_to`)
+		return relatesTo.Get("rel_type").Str == relType && relatesTo.Get("event_id").Str == relatesToEventID
+	})
+}
+
+// Check that the timeline for `roomID` contains the thread root `rootEventID` with a bundled thread
+// summary (`unsigned.m.relations.m.thread`) whose count is at least `minCount`.
+func SyncTimelineHasThreadSummary(roomID, rootEventID string, minCount int) SyncCheckOpt {
+	return SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+		if ev.Get("event_id").Str != rootEventID {
+			return false
+		}
+		count := ev.Get(`unsigned.m\.relations.m\.thread.count`)
+		return count.Exists() && count.Int() >= int64(minCount)
+	})
+}
+
+// Check that the timeline for `roomID` has the event `eventID` in its redacted form, i.e with
+// `unsigned.redacted_because` set. This checks the redacted event itself, not the redaction event.
+func SyncTimelineHasRedactedEvent(roomID, eventID string) SyncCheckOpt {
+	return SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+		return ev.Get("event_id").Str == eventID && ev.Get("unsigned.redacted_because").Exists()
+	})
+}
+
+// Check that the timeline for `roomID` contains `originalEventID` with a bundled edit
+// (`unsigned.m.relations.m.replace`). If `newBodyCheck` is not nil, it is called with the bundled
+// `m.replace` aggregation, which is the most recent replacement event, and must also pass.
+func SyncTimelineHasEdit(roomID, originalEventID string, newBodyCheck func(gjson.Result) bool) SyncCheckOpt {
+	return SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+		if ev.Get("event_id").Str != originalEventID {
+			return false
+		}
+		replace := ev.Get(`unsigned.m\.relations.m\.replace`)
+		if !replace.Exists() {
+			return false
+		}
+		return newBodyCheck == nil || newBodyCheck(replace)
+	})
+}
+
+// Check that the timeline for `roomID` contains `targetEventID` with a bundled annotation aggregation
+// (`unsigned.m.relations.m.annotation.chunk`) in which the reaction `key` has a count of exactly `count`.
+// A `count` of zero passes if there is no aggregation for `key`.
+func SyncAnnotationCountIs(roomID, targetEventID, key string, count int) SyncCheckOpt {
+	return SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+		if ev.Get("event_id").Str != targetEventID {
+			return false
+		}
+		got := int64(0)
+		for _, annotation := range ev.Get(`unsigned.m\.relations.m\.annotation.chunk`).Array() {
+			if annotation.Get("key").Str == key {
+				got = annotation.Get("count").Int()
+			}
+		}
+		return got == int64(count)
+	})
+}
+
+// Check that the timeline for `roomID` has an `m.room.tombstone` state event pointing to the room
+// `replacementRoomID`, which is sent when `roomID` is upgraded.
+func SyncTimelineHasTombstone(roomID, replacementRoomID string) SyncCheckOpt {
+	return SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.room.tombstone" && ev.Get("state_key").Exists() &&
+			ev.Get("content.replacement_room").Str == replacementRoomID
+	})
+}
+
+// Check that the timeline for `roomID` is limited, i.e there is a gap between this timeline and the
+// previous sync response. Use GetTimelinePrevBatch on the response to paginate into the gap.
+func SyncTimelineLimited(roomID string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		limited := topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID) + ".timeline.limited")
+		if !limited.Bool() {
+			return fmt.Errorf("SyncTimelineLimited(%s): timeline is not limited: %s", roomID, limited.Raw)
+		}
+		return nil
+	}
+}
+
+// GetTimelinePrevBatch extracts the timeline `prev_batch` token for `roomID` from a /sync response, as
+// returned by MustSync. Fails the test if the token is missing.
+func GetTimelinePrevBatch(t *testing.T, topLevelSyncJSON gjson.Result, roomID string) string {
+	t.Helper()
+	return GetJSONFieldStr(t, []byte(topLevelSyncJSON.Raw), "rooms.join."+GjsonEscape(roomID)+".timeline.prev_batch")
+}
+
 // Check that the state section for `roomID` has an event which passes the check function.
 // Note that the state section of a sync response only contains the change in state up to the start
 // of the timeline and will not contain the entire state of the room for incremental or
@@ -814,6 +1885,130 @@ func SyncStateHas(roomID string, check func(gjson.Result) bool) SyncCheckOpt {
 	}
 }
 
+// Check that a state event with the given type and state key is in either the state or the timeline section
+// for `roomID`, and that its content passes `contentCheck`. Both sections are checked as a state change
+// can be in either, depending on the sync. `contentCheck` may be nil to only check the event is present.
+func SyncStateEventPresent(roomID, eventType, stateKey string, contentCheck func(gjson.Result) bool) SyncCheckOpt {
+	check := func(ev gjson.Result) bool {
+		if ev.Get("type").Str != eventType || !ev.Get("state_key").Exists() || ev.Get("state_key").Str != stateKey {
+			return false
+		}
+		return contentCheck == nil || contentCheck(ev.Get("content"))
+	}
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		firstErr := loopArray(
+			topLevelSyncJSON, "rooms.join."+GjsonEscape(roomID)+".timeline.events", check,
+		)
+		if firstErr == nil {
+			return nil
+		}
+		secondErr := loopArray(
+			topLevelSyncJSON, "rooms.join."+GjsonEscape(roomID)+".state.events", check,
+		)
+		if secondErr == nil {
+			return nil
+		}
+		return fmt.Errorf("SyncStateEventPresent(%s, %s, %s): %s & %s", roomID, eventType, stateKey, firstErr, secondErr)
+	}
+}
+
+// Check that the `m.room.join_rules` of `roomID` has an `allow` condition of type `m.room_membership` for
+// `allowedViaRoomID`, i.e members of `allowedViaRoomID` may join the restricted room.
+func SyncJoinRulesAllows(roomID, allowedViaRoomID string) SyncCheckOpt {
+	return SyncStateEventPresent(roomID, "m.room.join_rules", "", func(content gjson.Result) bool {
+		for _, allow := range content.Get("allow").Array() {
+			if allow.Get("type").Str == "m.room_membership" && allow.Get("room_id").Str == allowedViaRoomID {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Check that the `m.room.create` event of `roomID` has a `predecessor` of `predecessorRoomID`, which is
+// the case for rooms created by upgrading `predecessorRoomID`.
+func SyncCreateHasPredecessor(roomID, predecessorRoomID string) SyncCheckOpt {
+	return SyncStateEventPresent(roomID, "m.room.create", "", func(content gjson.Result) bool {
+		return content.Get("predecessor.room_id").Str == predecessorRoomID
+	})
+}
+
+// Check that the `m.room.name` of `roomID` is `wantName`, in either the state or the timeline section.
+func SyncRoomNameIs(roomID, wantName string) SyncCheckOpt {
+	return SyncStateEventPresent(roomID, "m.room.name", "", func(content gjson.Result) bool {
+		return content.Get("name").Str == wantName
+	})
+}
+
+// Check that the `m.room.topic` of `roomID` is `wantTopic`, in either the state or the timeline section.
+func SyncRoomTopicIs(roomID, wantTopic string) SyncCheckOpt {
+	return SyncStateEventPresent(roomID, "m.room.topic", "", func(content gjson.Result) bool {
+		return content.Get("topic").Str == wantTopic
+	})
+}
+
+// Check that the `m.room.avatar` of `roomID` points at `wantMXC`, in either the state or the timeline section.
+func SyncRoomAvatarIs(roomID, wantMXC string) SyncCheckOpt {
+	return SyncStateEventPresent(roomID, "m.room.avatar", "", func(content gjson.Result) bool {
+		return content.Get("url").Str == wantMXC
+	})
+}
+
+// Check that the `m.room.guest_access` of `roomID` is `access`, in either the state or the timeline section.
+func SyncGuestAccessIs(roomID, access string) SyncCheckOpt {
+	return SyncStateEventPresent(roomID, "m.room.guest_access", "", func(content gjson.Result) bool {
+		return content.Get("guest_access").Str == access
+	})
+}
+
+// Check that `roomID` has encryption enabled with the given `algorithm`, e.g "m.megolm.v1.aes-sha2",
+// via an `m.room.encryption` event in either the state or the timeline section.
+func SyncEncryptionEnabled(roomID, algorithm string) SyncCheckOpt {
+	return SyncStateEventPresent(roomID, "m.room.encryption", "", func(content gjson.Result) bool {
+		return content.Get("algorithm").Str == algorithm
+	})
+}
+
+// Check that the power level of `userID` in `roomID` is `level`, according to an `m.room.power_levels` event
+// in either the state or the timeline section. If the user has no entry in `users`, their level is
+// `users_default`, which is itself 0 if absent.
+func SyncUserPowerLevelIs(roomID, userID string, level int) SyncCheckOpt {
+	return SyncStateEventPresent(roomID, "m.room.power_levels", "", func(content gjson.Result) bool {
+		userLevel := content.Get("users." + GjsonEscape(userID))
+		if !userLevel.Exists() {
+			userLevel = content.Get("users_default")
+		}
+		return int(userLevel.Int()) == level
+	})
+}
+
+// Check that the `m.room.canonical_alias` of `roomID` has `wantAlias` as its `alias`, in either the state or
+// the timeline section. An empty `wantAlias` checks that the canonical alias has been removed.
+func SyncCanonicalAliasIs(roomID, wantAlias string) SyncCheckOpt {
+	return SyncStateEventPresent(roomID, "m.room.canonical_alias", "", func(content gjson.Result) bool {
+		return content.Get("alias").Str == wantAlias
+	})
+}
+
+// Check that the `m.room.canonical_alias` of `roomID` lists `wantAlias` in its `alt_aliases`, in either the
+// state or the timeline section.
+func SyncCanonicalAltAliasesHas(roomID, wantAlias string) SyncCheckOpt {
+	return SyncStateEventPresent(roomID, "m.room.canonical_alias", "", func(content gjson.Result) bool {
+		for _, alias := range content.Get("alt_aliases").Array() {
+			if alias.Str == wantAlias {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Check that `roomID` has an `m.room.server_acl` event whose content passes `check`, in either the state or
+// the timeline section.
+func SyncServerACLIs(roomID string, check func(gjson.Result) bool) SyncCheckOpt {
+	return SyncStateEventPresent(roomID, "m.room.server_acl", "", check)
+}
+
 func SyncEphemeralHas(roomID string, check func(gjson.Result) bool) SyncCheckOpt {
 	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
 		err := loopArray(
@@ -863,74 +2058,251 @@ func SyncPresenceHas(fromUser string, expectedPresence *string, checks ...func(g
 	}
 }
 
-// Checks that `userID` gets invited to `roomID`.
-//
-// This checks different parts of the /sync response depending on the client making the request.
-// If the client is also the person being invited to the room then the 'invite' block will be inspected.
-// If the client is different to the person being invited then the 'join' block will be inspected.
-func SyncInvitedTo(userID, roomID string) SyncCheckOpt {
+// Check that an `m.typing` ephemeral event in `roomID` lists all of `userIDs` as typing. If `userIDs` is
+// empty, checks for an `m.typing` event with nobody typing, i.e typing has stopped.
+func SyncUsersTyping(roomID string, userIDs []string) SyncCheckOpt {
 	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
-		// two forms which depend on what the client user is:
-		// - passively viewing an invite for a room you're joined to (timeline events)
-		// - actively being invited to a room.
-		if clientUserID == userID {
-			// active
-			err := loopArray(
-				topLevelSyncJSON, "rooms.invite."+GjsonEscape(roomID)+".invite_state.events",
-				func(ev gjson.Result) bool {
-					return ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == userID && ev.Get("content.membership").Str == "invite"
-				},
-			)
-			if err != nil {
-				return fmt.Errorf("SyncInvitedTo(%s): %s", roomID, err)
+		err := SyncEphemeralHas(roomID, func(ev gjson.Result) bool {
+			if ev.Get("type").Str != "m.typing" {
+				return false
+			}
+			typing := make(map[string]bool)
+			for _, userID := range ev.Get("content.user_ids").Array() {
+				typing[userID.Str] = true
 			}
+			if len(userIDs) == 0 {
+				return len(typing) == 0
+			}
+			for _, userID := range userIDs {
+				if !typing[userID] {
+					return false
+				}
+			}
+			return true
+		})(clientUserID, topLevelSyncJSON)
+		if err == nil {
 			return nil
 		}
-		// passive
-		return SyncTimelineHas(roomID, func(ev gjson.Result) bool {
-			return ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == userID && ev.Get("content.membership").Str == "invite"
-		})(clientUserID, topLevelSyncJSON)
+		return fmt.Errorf("SyncUsersTyping(%v): %s", userIDs, err)
 	}
 }
 
-// Check that `userID` gets joined to `roomID` by inspecting the join timeline for a membership event.
+// Check that `userID` is not listed as typing in `roomID`. This also passes if there is no `m.typing`
+// ephemeral event for the room at all.
 //
-// Additional checks can be passed to narrow down the check, all must pass.
-func SyncJoinedTo(userID, roomID string, checks ...func(gjson.Result) bool) SyncCheckOpt {
-	checkJoined := func(ev gjson.Result) bool {
-		if ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == userID && ev.Get("content.membership").Str == "join" {
-			for _, check := range checks {
-				if !check(ev) {
-					// short-circuit, bail early
-					return false
+// Note: an incremental /sync only includes `m.typing` when the typing users have changed, so this will
+// trivially pass on an incremental sync even while `userID` is still typing. Use an initial /sync
+// (`SyncReq{}`) to check that the user has stopped typing.
+func SyncNoUserTyping(roomID, userID string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		for _, ev := range topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID) + ".ephemeral.events").Array() {
+			if ev.Get("type").Str != "m.typing" {
+				continue
+			}
+			for _, typingUserID := range ev.Get("content.user_ids").Array() {
+				if typingUserID.Str == userID {
+					return fmt.Errorf("SyncNoUserTyping(%s): %s is still typing", roomID, userID)
 				}
 			}
-			// passed both basic join check and all other checks
-			return true
 		}
-		return false
+		return nil
 	}
+}
+
+// Check that an `m.receipt` ephemeral event in `roomID` contains a receipt of type `receiptType` (e.g
+// "m.read") from `userID` for `eventID`. The `thread_id` of the receipt is not checked, see
+// SyncThreadedReceiptReceived.
+func SyncReceiptReceived(roomID, eventID, userID, receiptType string) SyncCheckOpt {
+	return syncReceiptReceived("SyncReceiptReceived", roomID, eventID, userID, receiptType, nil)
+}
+
+// Check that an `m.receipt` ephemeral event in `roomID` contains a receipt of type `receiptType` from
+// `userID` for `eventID` with the given `thread_id`.
+func SyncThreadedReceiptReceived(roomID, eventID, userID, receiptType, threadID string) SyncCheckOpt {
+	return syncReceiptReceived("SyncThreadedReceiptReceived", roomID, eventID, userID, receiptType, &threadID)
+}
+
+func syncReceiptReceived(name, roomID, eventID, userID, receiptType string, threadID *string) SyncCheckOpt {
 	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
-		// Check both the timeline and the state events for the join event
-		// since on initial sync, the state events may only be in
-		// <room>.state.events.
-		firstErr := loopArray(
-			topLevelSyncJSON, "rooms.join."+GjsonEscape(roomID)+".timeline.events", checkJoined,
-		)
-		if firstErr == nil {
+		err := SyncEphemeralHas(roomID, func(ev gjson.Result) bool {
+			if ev.Get("type").Str != "m.receipt" {
+				return false
+			}
+			receipt := ev.Get("content." + GjsonEscape(eventID) + "." + GjsonEscape(receiptType) + "." + GjsonEscape(userID))
+			if !receipt.Exists() {
+				return false
+			}
+			return threadID == nil || receipt.Get("thread_id").Str == *threadID
+		})(clientUserID, topLevelSyncJSON)
+		if err == nil {
 			return nil
 		}
+		return fmt.Errorf("%s(%s, %s): %s", name, eventID, userID, err)
+	}
+}
+
+// Check that `roomID` has at least one unread highlight, i.e `unread_notifications.highlight_count` is
+// greater than zero. Use CSAPI.MarkRoomAsRead to reset the count.
+func SyncHasHighlight(roomID string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		count := topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID) + ".unread_notifications.highlight_count")
+		if count.Int() <= 0 {
+			return fmt.Errorf("SyncHasHighlight(%s): highlight_count is %s", roomID, count.Raw)
+		}
+		return nil
+	}
+}
 
-		secondErr := loopArray(
-			topLevelSyncJSON, "rooms.join."+GjsonEscape(roomID)+".state.events", checkJoined,
+// Check that the unread notification and highlight counts (`unread_notifications`) for `roomID` are exactly
+// `notificationCount` and `highlightCount`.
+func SyncUnreadCountIs(roomID string, notificationCount, highlightCount int) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		unread := topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID) + ".unread_notifications")
+		if !unread.Exists() {
+			return fmt.Errorf("SyncUnreadCountIs(%s): no unread_notifications for room", roomID)
+		}
+		gotNotifications := unread.Get("notification_count").Int()
+		gotHighlights := unread.Get("highlight_count").Int()
+		if gotNotifications != int64(notificationCount) || gotHighlights != int64(highlightCount) {
+			return fmt.Errorf(
+				"SyncUnreadCountIs(%s): got notification_count=%d highlight_count=%d, want %d and %d",
+				roomID, gotNotifications, gotHighlights, notificationCount, highlightCount,
+			)
+		}
+		return nil
+	}
+}
+
+// Check that the sync contains any presence from `userID`, regardless of its state. This is useful for
+// asserting that presence is not shared with a user, by checking it never passes.
+func SyncPresenceFrom(userID string) SyncCheckOpt {
+	return SyncPresenceHas(userID, nil)
+}
+
+// Check that the sync contains presence from `userID` with the given presence state, e.g "online",
+// "offline" or "unavailable".
+func SyncPresenceIs(userID, presence string) SyncCheckOpt {
+	return SyncPresenceHas(userID, &presence)
+}
+
+// Checks that `userID` gets invited to `roomID`.
+//
+// This checks different parts of the /sync response depending on the client making the request.
+// If the client is also the person being invited to the room then the 'invite' block will be inspected.
+// If the client is different to the person being invited then the 'join' block will be inspected.
+func SyncInvitedTo(userID, roomID string) SyncCheckOpt {
+	return syncMembership("SyncInvitedTo", userID, roomID, "invite")
+}
+
+// Checks that `invitedUserID` gets invited to `roomID` by `inviterUserID`, by checking the sender of the
+// invite membership event.
+//
+// Like SyncInvitedTo, this checks the 'invite' block if the client is the person being invited, else
+// the 'join' block.
+func SyncInvitedBy(invitedUserID, inviterUserID, roomID string) SyncCheckOpt {
+	return syncMembership("SyncInvitedBy", invitedUserID, roomID, "invite", func(ev gjson.Result) bool {
+		return ev.Get("sender").Str == inviterUserID
+	})
+}
+
+// Check that the stripped state for the invite to `roomID` has an event which passes the check function.
+// This inspects `rooms.invite.{roomID}.invite_state.events` and so is only useful for the client being
+// invited.
+func SyncInviteStateHas(roomID string, check func(gjson.Result) bool) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := loopArray(
+			topLevelSyncJSON, "rooms.invite."+GjsonEscape(roomID)+".invite_state.events", check,
 		)
-		if secondErr == nil {
+		if err == nil {
 			return nil
 		}
-		return fmt.Errorf("SyncJoinedTo(%s): %s & %s", roomID, firstErr, secondErr)
+		return fmt.Errorf("SyncInviteStateHas(%s): %s", roomID, err)
+	}
+}
+
+// Check that the stripped state for the invite to `roomID` has an `m.room.name` event with the name `wantName`.
+func SyncInviteRoomNameIs(roomID, wantName string) SyncCheckOpt {
+	return SyncInviteStateHas(roomID, func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.room.name" && ev.Get("content.name").Str == wantName
+	})
+}
+
+// Check that the client has been invited to `roomID` and that the stripped state for the invite passes
+// the check function. Unlike SyncInviteStateHas, the check function is given every stripped state
+// event at once, so it can make assertions across multiple events.
+func SyncInviteWithStrippedState(roomID string, strippedCheck func(events []gjson.Result) bool) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		key := "rooms.invite." + GjsonEscape(roomID) + ".invite_state.events"
+		events := topLevelSyncJSON.Get(key)
+		if !events.Exists() {
+			return fmt.Errorf("SyncInviteWithStrippedState(%s): Key %s does not exist", roomID, key)
+		}
+		if !events.IsArray() {
+			return fmt.Errorf("SyncInviteWithStrippedState(%s): Key %s exists but it isn't an array", roomID, key)
+		}
+		if !strippedCheck(events.Array()) {
+			return fmt.Errorf("SyncInviteWithStrippedState(%s): check function did not pass for stripped state: %v", roomID, events.Raw)
+		}
+		return nil
 	}
 }
 
+// Check that the invite of `userID` to `roomID` has been rejected or retracted. This passes if a leave
+// membership event for `userID` is seen, or, when the client is `userID`, if the room no longer appears
+// in the 'invite' block.
+//
+// Note: an incremental /sync only includes rooms which have changed, so the room will be absent from the
+// 'invite' block of most incremental responses. Use an initial /sync (`SyncReq{}`) if relying on absence.
+func SyncInviteRetracted(userID, roomID string) SyncCheckOpt {
+	return syncMembershipRetracted("SyncInviteRetracted", userID, roomID, "invite")
+}
+
+// Check that the knock of `userID` on `roomID` has been retracted or denied. This passes if a leave
+// membership event for `userID` is seen, or, when the client is `userID`, if the room no longer appears
+// in the 'knock' block.
+//
+// Note: as with SyncInviteRetracted, use an initial /sync (`SyncReq{}`) if relying on absence.
+func SyncKnockRetracted(userID, roomID string) SyncCheckOpt {
+	return syncMembershipRetracted("SyncKnockRetracted", userID, roomID, "knock")
+}
+
+// syncMembershipRetracted checks that the room is no longer in the `section` block for `userID`, or that
+// `userID` has left the room.
+func syncMembershipRetracted(name, userID, roomID, section string) SyncCheckOpt {
+	isLeave := func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == userID && ev.Get("content.membership").Str == "leave"
+	}
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		if clientUserID != userID {
+			// passive
+			return SyncTimelineHas(roomID, isLeave)(clientUserID, topLevelSyncJSON)
+		}
+		// active
+		if !topLevelSyncJSON.Get("rooms." + section + "." + GjsonEscape(roomID)).Exists() {
+			return nil
+		}
+		err := loopArray(topLevelSyncJSON, "rooms.leave."+GjsonEscape(roomID)+".timeline.events", isLeave)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("%s(%s): room still in %s section: %s", name, roomID, section, err)
+	}
+}
+
+// Check that `userID` gets joined to `roomID` by inspecting the join timeline for a membership event.
+//
+// Additional checks can be passed to narrow down the check, all must pass.
+func SyncJoinedTo(userID, roomID string, checks ...func(gjson.Result) bool) SyncCheckOpt {
+	return syncMembership("SyncJoinedTo", userID, roomID, "join", checks...)
+}
+
+// Check that `remoteUserID`, a user on another homeserver, has joined `roomID`. This behaves exactly
+// like SyncJoinedTo, but makes it clear at the call site that the test is waiting for a join to be
+// replicated over federation.
+func SyncRemoteUserJoined(roomID, remoteUserID string) SyncCheckOpt {
+	return syncMembership("SyncRemoteUserJoined", remoteUserID, roomID, "join")
+}
+
 // Check that `userID` is leaving `roomID` by inspecting the timeline for a membership event, or witnessing `roomID` in `rooms.leave`
 // Note: This will not work properly with initial syncs, see https://github.com/matrix-org/matrix-doc/issues/3537
 func SyncLeftFrom(userID, roomID string) SyncCheckOpt {
@@ -954,6 +2326,187 @@ func SyncLeftFrom(userID, roomID string) SyncCheckOpt {
 	}
 }
 
+// Check that `userID` gets joined to `roomID` with a membership event whose `content.reason` is `reason`.
+func SyncJoinedToWithReason(userID, roomID, reason string) SyncCheckOpt {
+	return SyncJoinedTo(userID, roomID, func(ev gjson.Result) bool {
+		return ev.Get("content.reason").Str == reason
+	})
+}
+
+// Check that `userID` leaves `roomID` with a membership event whose `content.reason` is `reason`.
+//
+// Unlike SyncLeftFrom, this requires the leave event to be in the timeline when the client is the
+// user leaving, as the reason is not otherwise visible.
+func SyncLeftFromWithReason(userID, roomID, reason string) SyncCheckOpt {
+	return syncMembershipWithReason("SyncLeftFromWithReason", userID, roomID, "leave", reason)
+}
+
+// Check that `userID` is banned from `roomID` with a membership event whose `content.reason` is `reason`.
+func SyncBannedFromWithReason(userID, roomID, reason string) SyncCheckOpt {
+	return syncMembershipWithReason("SyncBannedFromWithReason", userID, roomID, "ban", reason)
+}
+
+// syncMembershipWithReason checks for a `membership` event for `userID` with the given reason.
+func syncMembershipWithReason(name, userID, roomID, membership, reason string) SyncCheckOpt {
+	return syncMembership(name, userID, roomID, membership, func(ev gjson.Result) bool {
+		return ev.Get("content.reason").Str == reason
+	})
+}
+
+// Check that `userID` has the membership `membership` (e.g "join", "invite", "leave", "ban" or "knock")
+// in `roomID` by looking for their `m.room.member` event.
+//
+// This checks different parts of the /sync response depending on the client making the request. If the
+// client is `userID` then the section of the response for that membership is inspected: the join
+// timeline and state, the invite or knock stripped state, or the leave timeline for "leave" and "ban".
+// Otherwise the client is observing the change in a room they are joined to, so the join timeline and
+// state are inspected.
+func SyncMembershipIs(roomID, userID, membership string) SyncCheckOpt {
+	return syncMembership("SyncMembershipIs", userID, roomID, membership)
+}
+
+// syncMembership checks for a `membership` event for `userID` in `roomID`, see SyncMembershipIs.
+// Additional checks can be passed to narrow down the check, all must pass.
+func syncMembership(name, userID, roomID, membership string, checks ...func(gjson.Result) bool) SyncCheckOpt {
+	checkMembership := func(ev gjson.Result) bool {
+		if ev.Get("type").Str != "m.room.member" || ev.Get("state_key").Str != userID || ev.Get("content.membership").Str != membership {
+			return false
+		}
+		for _, check := range checks {
+			if !check(ev) {
+				// short-circuit, bail early
+				return false
+			}
+		}
+		return true
+	}
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		// Check both the timeline and the state events for joined rooms
+		// since on initial sync, the state events may only be in
+		// <room>.state.events.
+		keys := []string{
+			"rooms.join." + GjsonEscape(roomID) + ".timeline.events",
+			"rooms.join." + GjsonEscape(roomID) + ".state.events",
+		}
+		if clientUserID == userID {
+			switch membership {
+			case "join":
+			case "invite":
+				keys = []string{"rooms.invite." + GjsonEscape(roomID) + ".invite_state.events"}
+			case "knock":
+				keys = []string{"rooms.knock." + GjsonEscape(roomID) + ".knock_state.events"}
+			default:
+				keys = []string{"rooms.leave." + GjsonEscape(roomID) + ".timeline.events"}
+			}
+		}
+		errs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			err := loopArray(topLevelSyncJSON, key, checkMembership)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("%s(%s): %s", name, roomID, strings.Join(errs, " & "))
+	}
+}
+
+// Check that the timeline for `roomID` has a join membership event for `userID` with the display name
+// `displayName`. This is how profile changes are observed by other users, including over federation.
+func SyncMemberDisplayNameIs(roomID, userID, displayName string) SyncCheckOpt {
+	return SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == userID &&
+			ev.Get("content.membership").Str == "join" && ev.Get("content.displayname").Str == displayName
+	})
+}
+
+// Check that the number of joined members in `roomID` is exactly `count`, by inspecting the
+// `m.room.member` events in the state and timeline sections of `rooms.join.{roomID}`.
+//
+// Note: /sync only returns deltas, so on an incremental sync this only counts the members whose
+// membership changed since the `since` token. Use `SyncReq{FullState: true}` to get an accurate count.
+func SyncJoinedMemberCountIs(roomID string, count int) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		room := topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID))
+		if !room.Exists() {
+			return fmt.Errorf("SyncJoinedMemberCountIs(%s): no join section for room", roomID)
+		}
+		// state events come before the timeline, so later timeline events overwrite them
+		memberships := make(map[string]string)
+		for _, section := range []string{"state.events", "timeline.events"} {
+			for _, ev := range room.Get(section).Array() {
+				if ev.Get("type").Str != "m.room.member" || !ev.Get("state_key").Exists() {
+					continue
+				}
+				memberships[ev.Get("state_key").Str] = ev.Get("content.membership").Str
+			}
+		}
+		joined := 0
+		for _, membership := range memberships {
+			if membership == "join" {
+				joined++
+			}
+		}
+		if joined != count {
+			return fmt.Errorf("SyncJoinedMemberCountIs(%s): got %d joined members, want %d", roomID, joined, count)
+		}
+		return nil
+	}
+}
+
+// Check that `roomID` appears in the join section of the /sync response.
+//
+// Unlike SyncJoinedTo, this does not look for the client's join membership event, so it passes as soon
+// as the room shows up at all. This is a weaker but faster signal, useful when joining rooms over
+// federation where the membership event may arrive in a later response.
+func SyncRoomJoined(roomID string) SyncCheckOpt {
+	return SyncRoomInSection(roomID, "join")
+}
+
+// Check that `roomID` appears in the given section of the /sync response, which is one of "join",
+// "invite", "leave" or "knock". For example, this can check that a room moved to the leave section
+// after a state reset.
+func SyncRoomInSection(roomID, section string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		if !topLevelSyncJSON.Get("rooms." + section + "." + GjsonEscape(roomID)).Exists() {
+			return fmt.Errorf("SyncRoomInSection(%s): no %s section for room", roomID, section)
+		}
+		return nil
+	}
+}
+
+// Check that the client is joined to a server notices room. A room is considered to be the server notices
+// room if its `m.tag` room account data contains the `m.server_notice` tag, as required by the spec.
+func SyncServerNoticeRoomExists() SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		for _, room := range topLevelSyncJSON.Get("rooms.join").Map() {
+			for _, ev := range room.Get("account_data.events").Array() {
+				if ev.Get("type").Str == "m.tag" && ev.Get(`content.tags.m\.server_notice`).Exists() {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("SyncServerNoticeRoomExists: no joined room has the m.server_notice tag")
+	}
+}
+
+// Check that `roomID` does not appear in any of the join, invite, knock or leave sections of the /sync
+// response.
+//
+// Note: an incremental /sync only includes rooms which have changed since the `since` token, so this
+// will trivially pass on an incremental sync where nothing happened in the room. Use an initial
+// /sync (`SyncReq{}`) or `SyncReq{FullState: true}` to assert that a room is absent entirely.
+func SyncRoomNotPresent(roomID string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		for _, section := range []string{"join", "invite", "knock", "leave"} {
+			if topLevelSyncJSON.Get("rooms." + section + "." + GjsonEscape(roomID)).Exists() {
+				return fmt.Errorf("SyncRoomNotPresent(%s): room is present in the %s section", roomID, section)
+			}
+		}
+		return nil
+	}
+}
+
 // Calls the `check` function for each global account data event, and returns with success if the
 // `check` function returns true for at least one event.
 func SyncGlobalAccountDataHas(check func(gjson.Result) bool) SyncCheckOpt {
@@ -962,6 +2515,41 @@ func SyncGlobalAccountDataHas(check func(gjson.Result) bool) SyncCheckOpt {
 	}
 }
 
+// Check that the global account data contains an event of type `eventType` whose content passes
+// the `check` function.
+func SyncGlobalAccountDataHasType(eventType string, check func(content gjson.Result) bool) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := loopArray(topLevelSyncJSON, "account_data.events", func(ev gjson.Result) bool {
+			return ev.Get("type").Str == eventType && check(ev.Get("content"))
+		})
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SyncGlobalAccountDataHasType(%s): %s", eventType, err)
+	}
+}
+
+// Check that the global account data event of type `eventType` has been removed. Servers differ in how
+// they represent this: some omit the event entirely, others send it with empty content. Both forms are
+// accepted.
+//
+// Note: as an incremental /sync only includes account data which has changed, absence will trivially
+// pass on an incremental sync. Use an initial /sync (`SyncReq{}`) to check the event is gone entirely.
+func SyncGlobalAccountDataRemoved(eventType string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		for _, ev := range topLevelSyncJSON.Get("account_data.events").Array() {
+			if ev.Get("type").Str != eventType {
+				continue
+			}
+			content := ev.Get("content")
+			if content.Exists() && len(content.Map()) > 0 {
+				return fmt.Errorf("SyncGlobalAccountDataRemoved(%s): event still has content: %s", eventType, content.Raw)
+			}
+		}
+		return nil
+	}
+}
+
 // Calls the `check` function for each account data event for the given room,
 // and returns with success if the `check` function returns true for at least
 // one event.
@@ -994,6 +2582,18 @@ func loopArray(object gjson.Result, key string, check func(gjson.Result) bool) e
 	return fmt.Errorf("check function did not pass while iterating over %d elements: %v", len(goArray), array.Raw)
 }
 
+// validateMxc returns an error if `mxcURI` is not of the form mxc://{server}/{mediaID}
+func validateMxc(mxcURI string) error {
+	if !strings.HasPrefix(mxcURI, "mxc://") {
+		return fmt.Errorf("%q does not start with mxc://", mxcURI)
+	}
+	mxcParts := strings.Split(strings.TrimPrefix(mxcURI, "mxc://"), "/")
+	if len(mxcParts) != 2 || mxcParts[0] == "" || mxcParts[1] == "" {
+		return fmt.Errorf("%q is not of the form mxc://{server}/{mediaID}", mxcURI)
+	}
+	return nil
+}
+
 // Splits an MXC URI into its origin and media ID parts
 func SplitMxc(mxcUri string) (string, string) {
 	mxcParts := strings.Split(strings.TrimPrefix(mxcUri, "mxc://"), "/")
@@ -1023,6 +2623,116 @@ func (c *CSAPI) SendToDeviceMessages(t *testing.T, evType string, messages map[s
 	)
 }
 
+// UpdateDevice sets the display name of `deviceID`, which must belong to the client's user. Fails the
+// test on non-2xx.
+func (c *CSAPI) UpdateDevice(t *testing.T, deviceID, displayName string) {
+	t.Helper()
+	c.MustDoFunc(
+		t, "PUT", []string{"_matrix", "client", "v3", "devices", deviceID},
+		WithJSONBody(t, map[string]interface{}{
+			"display_name": displayName,
+		}),
+	)
+}
+
+// DeleteDevices deletes all of `deviceIDs` via /delete_devices. If `auth` is not nil it is sent as the
+// User-Interactive Authentication `auth` object. The response is returned without checking the status
+// code, so that tests can inspect the 401 UIA response and retry with `auth`.
+func (c *CSAPI) DeleteDevices(t *testing.T, deviceIDs []string, auth interface{}) *http.Response {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"devices": deviceIDs,
+	}
+	if auth != nil {
+		reqBody["auth"] = auth
+	}
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "delete_devices"}, WithJSONBody(t, reqBody))
+}
+
+// UnsignedDeviceKeys returns the `device_keys` object for the client's device with the given public
+// identity keys, mapping key ID to key e.g "ed25519:DEVICEID" -> key, and the standard Olm and Megolm
+// algorithms. Sign the canonical JSON of this object with the device's ed25519 key, then add the result
+// under `signatures` before passing it to SetupDevice.
+func UnsignedDeviceKeys(c *CSAPI, keys map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"user_id":    c.UserID,
+		"device_id":  c.DeviceID,
+		"algorithms": []string{"m.olm.v1.curve25519-aes-sha2", "m.megolm.v1.aes-sha2"},
+		"keys":       keys,
+	}
+}
+
+// SetupDevice uploads `keys` as the signed `device_keys` object for the client's device, along with
+// `oneTimeKeys` if any are given, mapping key ID to either the public key or a signed key object, e.g
+// "signed_curve25519:AAAAHg" -> {"key": ..., "signatures": ...}. Use UnsignedDeviceKeys to build the
+// object to sign. Fails the test on non-2xx.
+//
+// Other users sharing a room with the client can then wait for the upload to be visible with
+// SyncDeviceListsChanged:
+//
+//	client.SetupDevice(t, alice, signedDeviceKeys, nil)
+//	bob.MustSyncUntil(t, client.SyncReq{Since: since}, client.SyncDeviceListsChanged(alice.UserID))
+func SetupDevice(t *testing.T, c *CSAPI, keys interface{}, oneTimeKeys map[string]interface{}) {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"device_keys": keys,
+	}
+	if len(oneTimeKeys) > 0 {
+		reqBody["one_time_keys"] = oneTimeKeys
+	}
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "keys", "upload"}, WithJSONBody(t, reqBody))
+}
+
+// Check that `userID` is listed in `device_lists.changed`.
+func SyncDeviceListsChanged(userID string) SyncCheckOpt {
+	return syncDeviceListsHas("SyncDeviceListsChanged", "changed", userID)
+}
+
+// Check that `userID` is listed in `device_lists.left`, which happens when the client no longer shares
+// any room with `userID`.
+func SyncDeviceListLeftContains(userID string) SyncCheckOpt {
+	return syncDeviceListsHas("SyncDeviceListLeftContains", "left", userID)
+}
+
+// syncDeviceListsHas checks that `device_lists.{section}` contains `userID`.
+func syncDeviceListsHas(name, section, userID string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		for _, u := range topLevelSyncJSON.Get("device_lists." + section).Array() {
+			if u.Str == userID {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s(%s): user not in device_lists.%s: %s", name, userID, section, topLevelSyncJSON.Get("device_lists").Raw)
+	}
+}
+
+// UploadCrossSigningKeys uploads the cross-signing keys in `body` (the `master_key`, `self_signing_key`
+// and `user_signing_key`) to /keys/device_signing/upload. If `auth` is not nil it is sent as the
+// User-Interactive Authentication `auth` object. The response is returned without checking the status
+// code, so that tests can inspect the 401 UIA response.
+func (c *CSAPI) UploadCrossSigningKeys(t *testing.T, body, auth interface{}) *http.Response {
+	t.Helper()
+	reqBody := map[string]interface{}{}
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("UploadCrossSigningKeys: failed to marshal body: %s", err)
+	}
+	if err = json.Unmarshal(b, &reqBody); err != nil {
+		t.Fatalf("UploadCrossSigningKeys: body is not a JSON object: %s", err)
+	}
+	if auth != nil {
+		reqBody["auth"] = auth
+	}
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "keys", "device_signing", "upload"}, WithJSONBody(t, reqBody))
+}
+
+// UploadSignatures uploads the signatures in `body` to /keys/signatures/upload. The body is nested as
+// user_id -> key_id -> signed object. Fails the test on non-2xx.
+func (c *CSAPI) UploadSignatures(t *testing.T, body interface{}) {
+	t.Helper()
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "keys", "signatures", "upload"}, WithJSONBody(t, body))
+}
+
 // Check that sync has received a to-device message,
 // with optional user filtering.
 //
@@ -1047,3 +2757,31 @@ func SyncToDeviceHas(fromUser string, check func(gjson.Result) bool) SyncCheckOp
 		return fmt.Errorf("SyncToDeviceHas(%v): %s", fromUser, err)
 	}
 }
+
+// Check that a to-device message of type `eventType` has been received from `senderUserID`.
+func SyncToDeviceFrom(senderUserID, eventType string) SyncCheckOpt {
+	check := SyncToDeviceHas(senderUserID, func(result gjson.Result) bool {
+		return result.Get("type").Str == eventType
+	})
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		if err := check(clientUserID, topLevelSyncJSON); err != nil {
+			return fmt.Errorf("SyncToDeviceFrom(%s, %s): %s", senderUserID, eventType, err)
+		}
+		return nil
+	}
+}
+
+// Check that the one-time key count for `algorithm` in `device_one_time_keys_count` is `count`.
+// If `count` is negative, only checks that a count for `algorithm` is present.
+func SyncOTKCount(algorithm string, count int) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		res := topLevelSyncJSON.Get("device_one_time_keys_count." + GjsonEscape(algorithm))
+		if !res.Exists() {
+			return fmt.Errorf("SyncOTKCount(%s): no one-time key count for algorithm", algorithm)
+		}
+		if count >= 0 && res.Int() != int64(count) {
+			return fmt.Errorf("SyncOTKCount(%s): got %d one-time keys, want %d", algorithm, res.Int(), count)
+		}
+		return nil
+	}
+}
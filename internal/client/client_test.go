@@ -0,0 +1,113 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestGjsonEscape(t *testing.T) {
+	testCases := []struct {
+		key  string
+		want string
+	}{
+		{key: "plain", want: "plain"},
+		{key: "@user:example.com", want: `\@user:example\.com`},
+		{key: "#alias:example.com", want: `\#alias:example\.com`},
+		{key: "!room:example.com", want: `\!room:example\.com`},
+		{key: "m.room.member", want: `m\.room\.member`},
+		{key: "what*is?this", want: `what\*is\?this`},
+		{key: "a|b", want: `a\|b`},
+		{key: `back\slash`, want: `back\\slash`},
+	}
+	for _, tc := range testCases {
+		got := GjsonEscape(tc.key)
+		if got != tc.want {
+			t.Errorf("GjsonEscape(%q): got %q want %q", tc.key, got, tc.want)
+		}
+		// the escaped key must select exactly the value stored under the unescaped key
+		obj := map[string]interface{}{
+			tc.key:  "found",
+			"other": "not found",
+		}
+		res := gjson.Get(mustMarshal(t, obj), "outer."+got)
+		if res.Str != "found" {
+			t.Errorf("GjsonEscape(%q): gjson.Get with escaped key returned %q", tc.key, res.Raw)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, obj map[string]interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(map[string]interface{}{
+		"outer": obj,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal JSON: %s", err)
+	}
+	return string(b)
+}
+
+func TestValidateMxc(t *testing.T) {
+	testCases := []struct {
+		mxcURI  string
+		wantErr bool
+	}{
+		{mxcURI: "mxc://example.com/abcdef", wantErr: false},
+		{mxcURI: "mxc://localhost:8448/abc_DEF-123", wantErr: false},
+		{mxcURI: "https://example.com/abcdef", wantErr: true},
+		{mxcURI: "mxc://example.com", wantErr: true},
+		{mxcURI: "mxc://example.com/", wantErr: true},
+		{mxcURI: "mxc:///abcdef", wantErr: true},
+		{mxcURI: "mxc://example.com/abc/def", wantErr: true},
+	}
+	for _, tc := range testCases {
+		err := validateMxc(tc.mxcURI)
+		if tc.wantErr && err == nil {
+			t.Errorf("validateMxc(%q): expected error, got none", tc.mxcURI)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("validateMxc(%q): unexpected error: %s", tc.mxcURI, err)
+		}
+	}
+}
+
+func TestUploadContentValidatesMxc(t *testing.T) {
+	contentURI := os.Getenv("COMPLEMENT_TEST_CONTENT_URI")
+	if contentURI == "" {
+		contentURI = "mxc://example.com/abcdef"
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"content_uri":"` + contentURI + `"}`))
+	}))
+	defer srv.Close()
+	c := &CSAPI{
+		BaseURL: srv.URL,
+		Client:  srv.Client(),
+	}
+	if got := c.UploadContent(t, []byte("hello"), "hello.txt", "text/plain"); got != contentURI {
+		t.Errorf("UploadContent: got %s want %s", got, contentURI)
+	}
+	if os.Getenv("COMPLEMENT_TEST_CONTENT_URI") != "" {
+		// we are the subprocess and UploadContent should have failed the test by now
+		return
+	}
+
+	// UploadContent fails the test on a bad URI, so run it in a subprocess and check that it failed.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestUploadContentValidatesMxc$")
+	cmd.Env = append(os.Environ(), "COMPLEMENT_TEST_CONTENT_URI=not-an-mxc-uri")
+	output, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Fatalf("UploadContent: expected the subprocess to exit with an error, got %v: %s", err, output)
+	}
+	if !strings.Contains(string(output), "malformed content_uri") {
+		t.Errorf("UploadContent: subprocess output is missing the malformed content_uri failure: %s", output)
+	}
+}